@@ -0,0 +1,61 @@
+package main
+
+import (
+	"image"
+	"sync"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/buckket/go-blurhash"
+)
+
+const blurHashXComponents = 4
+const blurHashYComponents = 3
+const blurHashSampleSize = 32
+
+// blurHashStore holds the last computed BlurHash per source URL so the
+// /:size.json endpoint and the X-Blurhash header can serve it without
+// recomputing it on every request.
+type blurHashStore struct {
+	mutex  sync.RWMutex
+	hashes map[string]string
+}
+
+func newBlurHashStore() *blurHashStore {
+	return &blurHashStore{hashes: map[string]string{}}
+}
+
+func (store *blurHashStore) Get(url string) (hash string, ok bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	hash, ok = store.hashes[url]
+
+	return
+}
+
+func (store *blurHashStore) Set(url, hash string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.hashes[url] = hash
+}
+
+var imageBlurHashes = newBlurHashStore()
+
+// computeBlurHash downscales originalImage to a cheap-to-encode sample and
+// returns a BlurHash string clients can render as a placeholder while the
+// full image downloads.
+func computeBlurHash(originalImage image.Image) (string, error) {
+	bounds := originalImage.Bounds().Size()
+
+	sampleWidth, sampleHeight := blurHashSampleSize, blurHashSampleSize
+	if bounds.X > bounds.Y {
+		sampleHeight = int(float64(blurHashSampleSize)*float64(bounds.Y)/float64(bounds.X) + 0.5)
+	} else if bounds.Y > bounds.X {
+		sampleWidth = int(float64(blurHashSampleSize)*float64(bounds.X)/float64(bounds.Y) + 0.5)
+	}
+
+	downscaled := transform.Resize(originalImage, sampleWidth, sampleHeight, transform.Linear)
+
+	return blurhash.Encode(blurHashXComponents, blurHashYComponents, downscaled)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlurHashStoreGetSet(test *testing.T) {
+	store := newBlurHashStore()
+
+	_, ok := store.Get("https://example.com/a.jpg")
+	assert.False(test, ok)
+
+	store.Set("https://example.com/a.jpg", "LEHV6nW...")
+
+	hash, ok := store.Get("https://example.com/a.jpg")
+	assert.True(test, ok)
+	assert.Equal(test, "LEHV6nW...", hash)
+}
+
+func TestComputeBlurHash(test *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 8), B: 128, A: 255})
+		}
+	}
+
+	hash, err := computeBlurHash(img)
+
+	assert.NoError(test, err)
+	assert.NotEmpty(test, hash)
+}
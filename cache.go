@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const diskCacheJanitorInterval = time.Minute
+
+// cachedImage is what both cache tiers store: the encoded bytes plus when
+// they were produced, so HTTP responses can carry an honest Last-Modified
+// even when served straight out of the in-memory ARC.
+type cachedImage struct {
+	Data    []byte
+	ModTime time.Time
+}
+
+// diskCache is the L2 tier backing imageCache's in-memory ARC (L1). Entries
+// are content-addressed by cache key so a restart does not require
+// re-downloading and re-encoding every image.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+}
+
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	return &diskCache{dir: dir, maxBytes: maxBytes}
+}
+
+func (cache *diskCache) path(key string) string {
+	return filepath.Join(cache.dir, key[:2], key)
+}
+
+// Get reads a cached entry, reporting the file's modification time so
+// callers can derive Last-Modified without keeping a separate index.
+func (cache *diskCache) Get(key string) (data []byte, modTime time.Time, ok bool) {
+	info, statError := os.Stat(cache.path(key))
+	if statError != nil {
+		return
+	}
+
+	contents, readError := ioutil.ReadFile(cache.path(key))
+	if readError != nil {
+		return
+	}
+
+	data = contents
+	modTime = info.ModTime()
+	ok = true
+
+	return
+}
+
+// Set writes an entry via a temp file + rename so a concurrent Get never
+// observes a partially written file.
+func (cache *diskCache) Set(key string, data []byte) error {
+	path := cache.path(key)
+
+	if mkdirError := os.MkdirAll(filepath.Dir(path), 0755); mkdirError != nil {
+		return mkdirError
+	}
+
+	tempFile, createError := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if createError != nil {
+		return createError
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, writeError := tempFile.Write(data); writeError != nil {
+		tempFile.Close()
+		return writeError
+	}
+
+	if closeError := tempFile.Close(); closeError != nil {
+		return closeError
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+type diskCacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// enforceBudget deletes the oldest entries until the cache's total size is
+// back under maxBytes.
+func (cache *diskCache) enforceBudget() {
+	var files []diskCacheFile
+	var total int64
+
+	filepath.Walk(cache.dir, func(path string, info os.FileInfo, walkError error) error {
+		if walkError != nil || info == nil || info.IsDir() {
+			return nil
+		}
+
+		files = append(files, diskCacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+
+		return nil
+	})
+
+	if total <= cache.maxBytes {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, file := range files {
+		if total <= cache.maxBytes {
+			break
+		}
+
+		if removeError := os.Remove(file.path); removeError == nil {
+			total -= file.size
+		}
+	}
+}
+
+// runJanitor enforces the disk budget in the background for as long as the
+// process runs.
+func (cache *diskCache) runJanitor() {
+	for {
+		cache.enforceBudget()
+		time.Sleep(diskCacheJanitorInterval)
+	}
+}
+
+// cacheGroup deduplicates concurrent requests for the same cache key so a
+// stampede of requests for a freshly-rotated image doesn't each redownload
+// and re-encode it.
+var cacheGroup = &singleflight.Group{}
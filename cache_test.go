@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCacheSetAndGet(test *testing.T) {
+	dir, err := ioutil.TempDir("", "random-background-cache")
+	assert.NoError(test, err)
+	defer os.RemoveAll(dir)
+
+	cache := newDiskCache(dir, 1024*1024)
+
+	assert.NoError(test, cache.Set("abcd", []byte("hello")))
+
+	data, _, ok := cache.Get("abcd")
+	assert.True(test, ok)
+	assert.Equal(test, []byte("hello"), data)
+
+	_, _, ok = cache.Get("missing")
+	assert.False(test, ok)
+}
+
+func TestDiskCacheEnforceBudgetEvictsOldest(test *testing.T) {
+	dir, err := ioutil.TempDir("", "random-background-cache")
+	assert.NoError(test, err)
+	defer os.RemoveAll(dir)
+
+	cache := newDiskCache(dir, 10)
+
+	assert.NoError(test, cache.Set("aaaa", []byte("0123456789")))
+	assert.NoError(test, cache.Set("bbbb", []byte("0123456789")))
+
+	cache.enforceBudget()
+
+	_, _, aFound := cache.Get("aaaa")
+	_, _, bFound := cache.Get("bbbb")
+
+	assert.False(test, aFound)
+	assert.True(test, bFound)
+}
+
+func TestDiskCachePathIsShardedByPrefix(test *testing.T) {
+	cache := newDiskCache("/tmp/cache", 0)
+
+	assert.Equal(test, filepath.Join("/tmp/cache", "ab", "abcd1234"), cache.path("abcd1234"))
+}
+
+func TestCacheGroupDedupesConcurrentCalls(test *testing.T) {
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	results := make(chan interface{}, 2)
+
+	go func() {
+		value, _, _ := cacheGroup.Do("key", func() (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-release
+			return "result", nil
+		})
+		results <- value
+	}()
+
+	<-started
+
+	go func() {
+		value, _, _ := cacheGroup.Do("key", func() (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return "result", nil
+		})
+		results <- value
+	}()
+
+	// Give the second call time to join the in-flight one before it completes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	assert.Equal(test, "result", <-results)
+	assert.Equal(test, "result", <-results)
+	assert.Equal(test, int32(1), atomic.LoadInt32(&calls))
+}
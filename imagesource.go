@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mojlighetsministeriet/utils/httprequest"
+)
+
+const instagramDataRegexp = "window\\._sharedData\\s*=\\s*([^;]+)"
+const localFileURLScheme = "file://"
+
+var allowedImageExtensions = regexp.MustCompile("(?i)\\.(je?pg|png)$")
+var instagramDataPattern = regexp.MustCompile(instagramDataRegexp)
+
+// ImageSource discovers image URLs from a single provider. Fetch is expected
+// to be called periodically by the refresh loop in main, so implementations
+// should not block longer than ctx allows.
+type ImageSource interface {
+	Fetch(ctx context.Context) ([]string, error)
+	Name() string
+}
+
+// fetchWithContext runs httpClient.Get on a goroutine and returns as soon as
+// either it completes or ctx is done, whichever comes first.
+// httprequest.Client does not expose a context-aware Get, so a stalled
+// request keeps running in the background after ctx cancellation; this still
+// lets a Fetch implementation honor ctx instead of blocking the refresh loop
+// indefinitely.
+func fetchWithContext(ctx context.Context, httpClient *httprequest.Client, url string) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := httpClient.Get(url)
+		done <- result{data, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.data, r.err
+	}
+}
+
+type instagramTagPageData struct {
+	EntryData instagramEntryData `json:"entry_data"`
+}
+
+type instagramEntryData struct {
+	TagPage []instagramTagPage `json:"TagPage"`
+}
+
+type instagramTagPage struct {
+	GraphQL instagramGraphQL `json:"graphql"`
+}
+
+type instagramGraphQL struct {
+	HashTag instagramHashTag `json:"hashtag"`
+}
+
+type instagramHashTag struct {
+	EdgeTopPosts instagramEdgeTopPosts `json:"edge_hashtag_to_top_posts"`
+}
+
+type instagramEdgeTopPosts struct {
+	Edges []instagramEdge `json:"edges"`
+}
+
+type instagramEdge struct {
+	Node instagramNode `json:"node"`
+}
+
+type instagramNode struct {
+	ID         string `json:"id"`
+	IsVideo    bool   `json:"is_video"`
+	DisplayURL string `json:"display_url"`
+}
+
+// InstagramTagSource scrapes the `window._sharedData` blob embedded in an
+// Instagram tag page. Instagram has repeatedly changed this markup, so
+// errors here are expected to be transient and are logged rather than fatal.
+type InstagramTagSource struct {
+	Tag        string
+	HTTPClient *httprequest.Client
+}
+
+// Name implements ImageSource.
+func (source *InstagramTagSource) Name() string {
+	return "instagram:" + source.Tag
+}
+
+// Fetch implements ImageSource.
+func (source *InstagramTagSource) Fetch(ctx context.Context) (urls []string, err error) {
+	pageURL := "https://www.instagram.com/explore/tags/" + source.Tag + "/"
+
+	response, fetchError := fetchWithContext(ctx, source.HTTPClient, pageURL)
+	if fetchError != nil {
+		err = fetchError
+		return
+	}
+
+	matches := instagramDataPattern.FindStringSubmatch(string(response))
+	if matches == nil {
+		err = errors.New("unable to find data for images from tag page " + pageURL + ", has instagram changed their HTML structure?")
+		return
+	}
+
+	instagramData := instagramTagPageData{}
+	if jsonError := json.Unmarshal([]byte(matches[1]), &instagramData); jsonError != nil {
+		err = fmt.Errorf("unable to parse data from instagram tag page %s: %w", pageURL, jsonError)
+		return
+	}
+
+	for _, page := range instagramData.EntryData.TagPage {
+		for _, edge := range page.GraphQL.HashTag.EdgeTopPosts.Edges {
+			if edge.Node.IsVideo == false && allowedImageExtensions.MatchString(edge.Node.DisplayURL) {
+				urls = append(urls, edge.Node.DisplayURL)
+			}
+		}
+	}
+
+	return
+}
+
+type unsplashPhoto struct {
+	URLs struct {
+		Regular string `json:"regular"`
+	} `json:"urls"`
+}
+
+// UnsplashSource queries Unsplash's public search API for a topic or
+// collection and requires an UNSPLASH_ACCESS_KEY.
+type UnsplashSource struct {
+	Query      string
+	AccessKey  string
+	HTTPClient *httprequest.Client
+}
+
+// Name implements ImageSource.
+func (source *UnsplashSource) Name() string {
+	return "unsplash:" + source.Query
+}
+
+// Fetch implements ImageSource.
+func (source *UnsplashSource) Fetch(ctx context.Context) (urls []string, err error) {
+	searchURL := "https://api.unsplash.com/search/photos?query=" + url.QueryEscape(source.Query) + "&client_id=" + url.QueryEscape(source.AccessKey)
+
+	response, fetchError := fetchWithContext(ctx, source.HTTPClient, searchURL)
+	if fetchError != nil {
+		err = fetchError
+		return
+	}
+
+	var result struct {
+		Results []unsplashPhoto `json:"results"`
+	}
+	if jsonError := json.Unmarshal(response, &result); jsonError != nil {
+		err = fmt.Errorf("unable to parse unsplash response for query %s: %w", source.Query, jsonError)
+		return
+	}
+
+	for _, photo := range result.Results {
+		if photo.URLs.Regular != "" {
+			urls = append(urls, photo.URLs.Regular)
+		}
+	}
+
+	return
+}
+
+type pixabayHit struct {
+	LargeImageURL string `json:"largeImageURL"`
+}
+
+// PixabaySource queries Pixabay's public search API for a topic and requires
+// a PIXABAY_API_KEY.
+type PixabaySource struct {
+	Query      string
+	APIKey     string
+	HTTPClient *httprequest.Client
+}
+
+// Name implements ImageSource.
+func (source *PixabaySource) Name() string {
+	return "pixabay:" + source.Query
+}
+
+// Fetch implements ImageSource.
+func (source *PixabaySource) Fetch(ctx context.Context) (urls []string, err error) {
+	searchURL := "https://pixabay.com/api/?key=" + url.QueryEscape(source.APIKey) + "&q=" + url.QueryEscape(source.Query) + "&image_type=photo"
+
+	response, fetchError := fetchWithContext(ctx, source.HTTPClient, searchURL)
+	if fetchError != nil {
+		err = fetchError
+		return
+	}
+
+	var result struct {
+		Hits []pixabayHit `json:"hits"`
+	}
+	if jsonError := json.Unmarshal(response, &result); jsonError != nil {
+		err = fmt.Errorf("unable to parse pixabay response for query %s: %w", source.Query, jsonError)
+		return
+	}
+
+	for _, hit := range result.Hits {
+		if hit.LargeImageURL != "" {
+			urls = append(urls, hit.LargeImageURL)
+		}
+	}
+
+	return
+}
+
+// LocalDirectorySource scans a mounted folder for images instead of calling
+// out to a remote provider.
+type LocalDirectorySource struct {
+	Directory string
+}
+
+// Name implements ImageSource.
+func (source *LocalDirectorySource) Name() string {
+	return "local:" + source.Directory
+}
+
+// Fetch implements ImageSource.
+func (source *LocalDirectorySource) Fetch(ctx context.Context) (urls []string, err error) {
+	entries, readError := ioutil.ReadDir(source.Directory)
+	if readError != nil {
+		err = readError
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !allowedImageExtensions.MatchString(entry.Name()) {
+			continue
+		}
+
+		urls = append(urls, "file://"+filepath.Join(source.Directory, entry.Name()))
+	}
+
+	return
+}
+
+type mastodonMediaAttachment struct {
+	URL string `json:"url"`
+}
+
+type mastodonStatus struct {
+	MediaAttachments []mastodonMediaAttachment `json:"media_attachments"`
+}
+
+// MastodonHashtagSource reads the public hashtag timeline of a Mastodon
+// instance, which returns media attachments as plain JSON with no scraping
+// required.
+type MastodonHashtagSource struct {
+	Instance   string
+	Hashtag    string
+	HTTPClient *httprequest.Client
+}
+
+// Name implements ImageSource.
+func (source *MastodonHashtagSource) Name() string {
+	return "mastodon:" + source.Instance + "/" + source.Hashtag
+}
+
+// Fetch implements ImageSource.
+func (source *MastodonHashtagSource) Fetch(ctx context.Context) (urls []string, err error) {
+	timelineURL := "https://" + source.Instance + "/api/v1/timelines/tag/" + url.PathEscape(source.Hashtag)
+
+	response, fetchError := fetchWithContext(ctx, source.HTTPClient, timelineURL)
+	if fetchError != nil {
+		err = fetchError
+		return
+	}
+
+	var statuses []mastodonStatus
+	if jsonError := json.Unmarshal(response, &statuses); jsonError != nil {
+		err = fmt.Errorf("unable to parse mastodon timeline for %s: %w", source.Name(), jsonError)
+		return
+	}
+
+	for _, status := range statuses {
+		for _, media := range status.MediaAttachments {
+			if media.URL != "" {
+				urls = append(urls, media.URL)
+			}
+		}
+	}
+
+	return
+}
+
+// fetchSourceImage reads the bytes for a URL produced by an ImageSource,
+// reading straight off disk for the file:// URLs LocalDirectorySource
+// returns instead of issuing an HTTP request for them.
+func fetchSourceImage(httpClient *httprequest.Client, sourceURL string) ([]byte, error) {
+	if strings.HasPrefix(sourceURL, localFileURLScheme) {
+		return ioutil.ReadFile(strings.TrimPrefix(sourceURL, localFileURLScheme))
+	}
+
+	return httpClient.Get(sourceURL)
+}
+
+// parseImageSources turns an IMAGE_SOURCES value such as
+// "instagram:landskap,unsplash:nature,mastodon:mastodon.social/landscape"
+// into the configured ImageSource implementations.
+func parseImageSources(config string, httpClient *httprequest.Client) (sources []ImageSource, err error) {
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			err = errors.New("invalid IMAGE_SOURCES entry, expected type:parameter: " + entry)
+			return
+		}
+
+		sourceType := parts[0]
+		parameter := parts[1]
+
+		switch sourceType {
+		case "instagram":
+			sources = append(sources, &InstagramTagSource{Tag: parameter, HTTPClient: httpClient})
+		case "unsplash":
+			sources = append(sources, &UnsplashSource{Query: parameter, AccessKey: os.Getenv("UNSPLASH_ACCESS_KEY"), HTTPClient: httpClient})
+		case "pixabay":
+			sources = append(sources, &PixabaySource{Query: parameter, APIKey: os.Getenv("PIXABAY_API_KEY"), HTTPClient: httpClient})
+		case "local":
+			sources = append(sources, &LocalDirectorySource{Directory: parameter})
+		case "mastodon":
+			instance, hashtag := parameter, ""
+			if slashIndex := strings.Index(parameter, "/"); slashIndex != -1 {
+				instance = parameter[:slashIndex]
+				hashtag = parameter[slashIndex+1:]
+			}
+			sources = append(sources, &MastodonHashtagSource{Instance: instance, Hashtag: hashtag, HTTPClient: httpClient})
+		default:
+			err = errors.New("unknown image source type: " + sourceType)
+			return
+		}
+	}
+
+	return
+}
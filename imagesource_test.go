@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageSources(test *testing.T) {
+	sources, err := parseImageSources("instagram:landskap, unsplash:nature,mastodon:mastodon.social/landscape", nil)
+
+	assert.NoError(test, err)
+	assert.Len(test, sources, 3)
+	assert.Equal(test, "instagram:landskap", sources[0].Name())
+	assert.Equal(test, "unsplash:nature", sources[1].Name())
+	assert.Equal(test, "mastodon:mastodon.social/landscape", sources[2].Name())
+}
+
+func TestParseImageSourcesWithInvalidEntry(test *testing.T) {
+	_, err := parseImageSources("instagram", nil)
+
+	assert.Error(test, err)
+}
+
+func TestParseImageSourcesWithUnknownType(test *testing.T) {
+	_, err := parseImageSources("flickr:nature", nil)
+
+	assert.Error(test, err)
+}
+
+func TestLocalDirectorySourceFetch(test *testing.T) {
+	dir, err := ioutil.TempDir("", "random-background-local-source")
+	assert.NoError(test, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(test, ioutil.WriteFile(filepath.Join(dir, "a.jpg"), []byte("fake"), 0644))
+	assert.NoError(test, ioutil.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("fake"), 0644))
+
+	source := &LocalDirectorySource{Directory: dir}
+	urls, fetchError := source.Fetch(nil)
+
+	assert.NoError(test, fetchError)
+	assert.Equal(test, []string{"file://" + filepath.Join(dir, "a.jpg")}, urls)
+}
+
+func TestFetchSourceImageReadsLocalFileURLs(test *testing.T) {
+	dir, err := ioutil.TempDir("", "random-background-local-source")
+	assert.NoError(test, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.jpg")
+	assert.NoError(test, ioutil.WriteFile(path, []byte("fake-image-bytes"), 0644))
+
+	data, fetchError := fetchSourceImage(nil, "file://"+path)
+
+	assert.NoError(test, fetchError)
+	assert.Equal(test, []byte("fake-image-bytes"), data)
+}
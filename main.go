@@ -1,22 +1,18 @@
 package main // import "github.com/mojlighetsministeriet/random-background"
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"image"
 	"math/rand"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/anthonynsimon/bild/blur"
 	"github.com/anthonynsimon/bild/imgio"
-	"github.com/anthonynsimon/bild/transform"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/labstack/echo"
 	"github.com/mojlighetsministeriet/utils"
@@ -25,8 +21,6 @@ import (
 )
 
 const imageQuality = 85
-const instagramTagPageURL = "https://www.instagram.com/explore/tags/landskap/"
-const instagramDataRegexp = "window\\._sharedData\\s*=\\s*([^;]+)"
 
 type imageSize struct {
 	Name   string
@@ -84,42 +78,11 @@ func (sizes *imageSizes) Largest() (largest imageSize) {
 	return
 }
 
-type instagramTagPageData struct {
-	EntryData instagramEntryData `json:"entry_data"`
-}
-
-type instagramEntryData struct {
-	TagPage []instagramTagPage `json:"TagPage"`
-}
-
-type instagramTagPage struct {
-	GraphQL instagramGraphQL `json:"graphql"`
-}
-
-type instagramGraphQL struct {
-	HashTag instagramHashTag `json:"hashtag"`
-}
-
-type instagramHashTag struct {
-	EdgeTopPosts instagramEdgeTopPosts `json:"edge_hashtag_to_top_posts"`
-}
-
-type instagramEdgeTopPosts struct {
-	Edges []instagramEdge `json:"edges"`
-}
-
-type instagramEdge struct {
-	Node instagramNode `json:"node"`
-}
-
-type instagramNode struct {
-	ID         string `json:"id"`
-	IsVideo    bool   `json:"is_video"`
-	DisplayURL string `json:"display_url"`
-}
+const cacheMaxAgeSeconds = 3600
 
 var imageURLs []string
 var imageCache *lru.ARCCache
+var diskImageCache *diskCache
 
 func getCroppingRectangleForAspectRatio(size imageSize, newAspectRatio float64) image.Rectangle {
 	aspectRatio := float64(size.Width) / float64(size.Height)
@@ -149,37 +112,13 @@ func bytesToImage(input []byte) (output image.Image, err error) {
 	return
 }
 
-func resizeAndCropImage(imageData []byte, size imageSize) (resizedImage []byte, err error) {
-	originalImage, err := bytesToImage(imageData)
-	if err != nil {
-		return
-	}
-
-	boundsSize := originalImage.Bounds().Size()
-	originalSize := imageSize{Width: boundsSize.X, Height: boundsSize.Y}
-
-	resizedAspectRatio := float64(size.Width) / float64(size.Height)
-
-	croppedImage := transform.Crop(originalImage, getCroppingRectangleForAspectRatio(originalSize, resizedAspectRatio))
-	result := transform.Resize(croppedImage, size.Width, size.Height, transform.MitchellNetravali)
-
-	var buffer bytes.Buffer
-	writer := bufio.NewWriter(&buffer)
-	err = imgio.JPEGEncoder(imageQuality)(writer, result)
-	if err != nil {
-		return
-	}
-
-	resizedImage = buffer.Bytes()
-
-	return
-}
-
-func getOriginalImage(url string, cache *lru.ARCCache) (imageResult []byte, err error) {
+// getOriginalImage returns the source image re-encoded as JPEG at full
+// quality, unresized and unblurred so it can be shared as the basis for every
+// transform variant requested for the same URL.
+func getOriginalImage(url string) (result cachedImage, err error) {
 	originalImageCacheKey := url + "|original"
-	cachedOriginalImage, found := imageCache.Get(originalImageCacheKey)
-	if found == true {
-		imageResult = cachedOriginalImage.([]byte)
+	if cached, found := imageCache.Get(originalImageCacheKey); found == true {
+		result = cached.(cachedImage)
 		return
 	}
 
@@ -189,7 +128,7 @@ func getOriginalImage(url string, cache *lru.ARCCache) (imageResult []byte, err
 		return
 	}
 
-	originalImageData, imageGetError := httpClient.Get(url)
+	originalImageData, imageGetError := fetchSourceImage(httpClient, url)
 	if imageGetError != nil {
 		err = imageGetError
 		return
@@ -201,46 +140,90 @@ func getOriginalImage(url string, cache *lru.ARCCache) (imageResult []byte, err
 		return
 	}
 
-	originalImage = blur.Gaussian(originalImage, 10)
-
 	buffer := new(bytes.Buffer)
-	writer := bufio.NewWriter(buffer)
-	err = imgio.JPEGEncoder(100)(writer, originalImage)
+	err = imgio.JPEGEncoder(100)(buffer, originalImage)
 	if err != nil {
 		return
 	}
 
-	imageCache.Add(originalImageCacheKey, buffer.Bytes())
+	result = cachedImage{Data: buffer.Bytes(), ModTime: time.Now()}
+	imageCache.Add(originalImageCacheKey, result)
 
 	return
 }
 
-func getImage(url string, size imageSize, cache *lru.ARCCache) (imageResult []byte, err error) {
-	cacheKey := url + "|" + size.String()
-
-	cachedImage, found := imageCache.Get(cacheKey)
-	if found == true {
-		imageResult = cachedImage.([]byte)
+// cachedTransform checks the in-memory ARC (L1) and, if configured, the
+// on-disk cache (L2) for cacheKey before falling back to loadOriginal and
+// transforming it. Concurrent requests for the same cache key are
+// deduplicated via cacheGroup so a cache stampede doesn't redownload and
+// re-encode the same image twice.
+func cachedTransform(cacheKey string, opts transformOptions, loadOriginal func() (image.Image, error)) (result cachedImage, err error) {
+	if cached, found := imageCache.Get(cacheKey); found == true {
+		result = cached.(cachedImage)
 		return
 	}
 
-	originalImage, originalImageError := getOriginalImage(url, cache)
-	if originalImageError != nil {
-		err = originalImageError
-		return
-	}
+	value, computeError, _ := cacheGroup.Do(cacheKey, func() (interface{}, error) {
+		if diskImageCache != nil {
+			if diskData, diskModTime, diskFound := diskImageCache.Get(cacheKey); diskFound {
+				cached := cachedImage{Data: diskData, ModTime: diskModTime}
+				imageCache.Add(cacheKey, cached)
+				return cached, nil
+			}
+		}
 
-	imageResult, resizeError := resizeAndCropImage(originalImage, size)
-	if resizeError != nil {
-		err = resizeError
+		originalImage, originalError := loadOriginal()
+		if originalError != nil {
+			return nil, originalError
+		}
+
+		transformed, transformError := transformImage(originalImage, opts)
+		if transformError != nil {
+			return nil, transformError
+		}
+
+		cached := cachedImage{Data: transformed, ModTime: time.Now()}
+		imageCache.Add(cacheKey, cached)
+
+		if diskImageCache != nil {
+			diskImageCache.Set(cacheKey, transformed)
+		}
+
+		return cached, nil
+	})
+	if computeError != nil {
+		err = computeError
 		return
 	}
 
-	imageCache.Add(cacheKey, imageResult)
+	result = value.(cachedImage)
 
 	return
 }
 
+// getImage returns the transformed image for url+opts, downloading and
+// decoding the original on demand.
+func getImage(url string, opts transformOptions) (cachedImage, error) {
+	return cachedTransform(transformCacheKey(url, opts), opts, func() (image.Image, error) {
+		original, err := getOriginalImage(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytesToImage(original.Data)
+	})
+}
+
+// getImageFromDecoded is the precache-worker counterpart to getImage: it
+// reuses an already-decoded original instead of fetching and decoding it
+// again, so pre-generating every registered size costs one decode per URL
+// rather than one per size.
+func getImageFromDecoded(url string, opts transformOptions, originalImage image.Image) (cachedImage, error) {
+	return cachedTransform(transformCacheKey(url, opts), opts, func() (image.Image, error) {
+		return originalImage, nil
+	})
+}
+
 func getImageSizes() imageSizes {
 	return imageSizes{
 		Sizes: []imageSize{
@@ -250,49 +233,95 @@ func getImageSizes() imageSizes {
 	}
 }
 
-func sendImage(context echo.Context) error {
-	sizes := getImageSizes()
-
-	size, ok := sizes.Get(context.Param("size"))
-	if ok == false {
-		return context.String(http.StatusBadRequest, "The URL needs to end with one of: "+sizes.String())
-	}
-
+func sendRandomImage(context echo.Context, opts transformOptions) error {
 	if len(imageURLs) == 0 {
 		return context.String(http.StatusServiceUnavailable, "Unable to return an image at this moment, try again in a bit")
 	}
 
 	rand.Seed(time.Now().Unix())
 	imageURLIndex := rand.Int() % len(imageURLs)
-	image, imageError := getImage(imageURLs[imageURLIndex], size, imageCache)
+	url := imageURLs[imageURLIndex]
+
+	image, imageError := getImage(url, opts)
 	if imageError != nil {
 		context.Logger().Error(imageError)
 		return context.String(http.StatusServiceUnavailable, "Unable to return an image at this moment, try again in a bit")
 	}
 
-	return context.Blob(http.StatusOK, "image/jpeg", image)
-}
+	etag := "\"" + contentHash(image.Data) + "\""
+	lastModified := image.ModTime.UTC().Truncate(time.Second)
+
+	header := context.Response().Header()
+	header.Set(echo.HeaderCacheControl, "public, max-age="+strconv.Itoa(cacheMaxAgeSeconds))
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	if hash, ok := imageBlurHashes.Get(url); ok {
+		header.Set("X-Blurhash", hash)
+	}
 
-func resizeLargestWorker(jobs <-chan string, sizes imageSizes) {
-	largest := sizes.Largest()
+	if context.Request().Header.Get("If-None-Match") == etag {
+		return context.NoContent(http.StatusNotModified)
+	}
 
-	for url := range jobs {
-		getImage(url, largest, imageCache)
-		time.Sleep(5 * time.Second)
+	if ifModifiedSince := context.Request().Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		if since, parseError := http.ParseTime(ifModifiedSince); parseError == nil && !lastModified.After(since) {
+			return context.NoContent(http.StatusNotModified)
+		}
 	}
+
+	return context.Blob(http.StatusOK, opts.contentType(), image.Data)
 }
 
-func preCacheLargestImages(imageURLs []string) {
+func sendImage(context echo.Context) error {
 	sizes := getImageSizes()
-	jobs := make(chan string, len(imageURLs))
 
-	go resizeLargestWorker(jobs, sizes)
+	size, ok := sizes.Get(context.Param("size"))
+	if ok == false {
+		return context.String(http.StatusBadRequest, "The URL needs to end with one of: "+sizes.String())
+	}
 
-	for _, url := range imageURLs {
-		jobs <- url
+	opts, optsError := parseTransformOptions(context, size.Width, size.Height)
+	if optsError != nil {
+		return context.String(http.StatusBadRequest, optsError.Error())
 	}
 
-	close(jobs)
+	return sendRandomImage(context, opts)
+}
+
+type imageMetadata struct {
+	URL      string `json:"url"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	BlurHash string `json:"blurhash"`
+}
+
+func sendImageMetadata(size imageSize) echo.HandlerFunc {
+	return func(context echo.Context) error {
+		if len(imageURLs) == 0 {
+			return context.String(http.StatusServiceUnavailable, "Unable to return an image at this moment, try again in a bit")
+		}
+
+		rand.Seed(time.Now().Unix())
+		url := imageURLs[rand.Int()%len(imageURLs)]
+
+		hash, _ := imageBlurHashes.Get(url)
+
+		return context.JSON(http.StatusOK, imageMetadata{URL: url, Width: size.Width, Height: size.Height, BlurHash: hash})
+	}
+}
+
+func sendCustomImage(context echo.Context) error {
+	width, height, dimensionsError := parseCustomDimensions(context)
+	if dimensionsError != nil {
+		return context.String(http.StatusBadRequest, dimensionsError.Error())
+	}
+
+	opts, optsError := parseTransformOptions(context, width, height)
+	if optsError != nil {
+		return context.String(http.StatusBadRequest, optsError.Error())
+	}
+
+	return sendRandomImage(context, opts)
 }
 
 func main() {
@@ -314,44 +343,46 @@ func main() {
 		panic(err)
 	}
 
-	allowedImageExtensions := regexp.MustCompile("(?i)\\.(je?pg|png)$")
-	instagramDataPattern := regexp.MustCompile(instagramDataRegexp)
+	if cacheDir := utils.GetEnv("CACHE_DIR", ""); cacheDir != "" {
+		maxBytes, maxBytesError := strconv.ParseInt(utils.GetEnv("CACHE_MAX_BYTES", "1073741824"), 10, 64)
+		if maxBytesError != nil {
+			panic(maxBytesError)
+		}
+
+		diskImageCache = newDiskCache(cacheDir, maxBytes)
+		go diskImageCache.runJanitor()
+	}
+
+	imageSources, sourcesError := parseImageSources(utils.GetEnv("IMAGE_SOURCES", "instagram:landskap"), httpClient)
+	if sourcesError != nil {
+		panic(sourcesError)
+	}
+
+	var precacheCancel context.CancelFunc
 
 	go func() {
 		for {
 			var newImageURLs []string
 
-			response, fetchError := httpClient.Get(instagramTagPageURL)
-			if fetchError != nil {
-				server.Logger.Error(fetchError)
-				continue
-			}
+			for _, source := range imageSources {
+				sourceURLs, fetchError := source.Fetch(context.Background())
+				if fetchError != nil {
+					server.Logger.Error(errors.New(source.Name() + ": " + fetchError.Error()))
+					continue
+				}
 
-			matches := instagramDataPattern.FindStringSubmatch(string(response))
-			if matches == nil {
-				server.Logger.Error(errors.New("Unable to find data for images from tag page " + instagramTagPageURL + ", has instagram changed their HTML structure?"))
-				continue
+				newImageURLs = append(newImageURLs, sourceURLs...)
 			}
 
-			instagramData := instagramTagPageData{}
-			insagramDataError := json.Unmarshal([]byte(matches[1]), &instagramData)
-			if insagramDataError != nil {
-				server.Logger.Error(errors.New("Unable to parse data from instagram tag page " + instagramTagPageURL + ", has instagram changed their HTML structure?"))
-				server.Logger.Error(insagramDataError)
-				continue
-			}
+			imageURLs = newImageURLs
 
-			for _, page := range instagramData.EntryData.TagPage {
-				for _, edge := range page.GraphQL.HashTag.EdgeTopPosts.Edges {
-					if edge.Node.IsVideo == false && allowedImageExtensions.Match([]byte(edge.Node.DisplayURL)) {
-						newImageURLs = append(newImageURLs, edge.Node.DisplayURL)
-					}
-				}
+			if precacheCancel != nil {
+				precacheCancel()
 			}
 
-			imageURLs = newImageURLs
-
-			preCacheLargestImages(imageURLs)
+			var precacheCtx context.Context
+			precacheCtx, precacheCancel = context.WithCancel(context.Background())
+			go precacheImages(precacheCtx, imageURLs)
 
 			time.Sleep(time.Hour)
 		}
@@ -363,6 +394,11 @@ func main() {
 	})
 
 	server.GET("/:size", sendImage)
+	server.GET("/custom", sendCustomImage)
+
+	for _, size := range getImageSizes().Sizes {
+		server.GET("/"+strings.Replace(size.Name, ".jpg", ".json", 1), sendImageMetadata(size))
+	}
 
 	server.Listen(":" + utils.GetEnv("PORT", "443"))
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+
+	"github.com/anthonynsimon/bild/blur"
+	"github.com/anthonynsimon/bild/effect"
+	"github.com/anthonynsimon/bild/imgio"
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/chai2010/webp"
+	"github.com/labstack/echo"
+	"github.com/muesli/smartcrop"
+	"github.com/muesli/smartcrop/nfnt"
+)
+
+const defaultBlurRadius = 10.0
+const maxBlurRadius = 50.0
+const minCustomDimension = 16
+const maxCustomDimension = 3840
+
+// transformOptions describes the per-request image transform applied on top
+// of the cached original: how it is fit into the target box, whether it is
+// blurred or desaturated, and what format/quality it is encoded with.
+type transformOptions struct {
+	Width     int
+	Height    int
+	Blur      float64
+	Fit       string
+	Format    string
+	Quality   int
+	Grayscale bool
+}
+
+// String returns a canonical representation used to derive the cache key, so
+// any change to a transform parameter produces a distinct cached variant.
+func (opts transformOptions) String() string {
+	return fmt.Sprintf("%dx%d|blur=%.2f|fit=%s|fmt=%s|q=%d|gray=%t",
+		opts.Width, opts.Height, opts.Blur, opts.Fit, opts.Format, opts.Quality, opts.Grayscale)
+}
+
+func (opts transformOptions) contentType() string {
+	switch opts.Format {
+	case "png":
+		return "image/png"
+	case "webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// parseTransformOptions reads the optional blur/fit/fmt/q/grayscale query
+// parameters on top of a base width and height, falling back to the
+// long-standing defaults (a 10px gaussian blur, center-crop, JPEG) when a
+// parameter is not given.
+func parseTransformOptions(context echo.Context, width, height int) (opts transformOptions, err error) {
+	opts = transformOptions{
+		Width:   width,
+		Height:  height,
+		Blur:    defaultBlurRadius,
+		Fit:     "cover",
+		Format:  "jpeg",
+		Quality: imageQuality,
+	}
+
+	if blurParam := context.QueryParam("blur"); blurParam != "" {
+		blurValue, parseError := strconv.ParseFloat(blurParam, 64)
+		if parseError != nil || blurValue < 0 || blurValue > maxBlurRadius {
+			err = fmt.Errorf("blur must be a number between 0 and %d", int(maxBlurRadius))
+			return
+		}
+		opts.Blur = blurValue
+	}
+
+	if fitParam := context.QueryParam("fit"); fitParam != "" {
+		switch fitParam {
+		case "cover", "contain", "smartcrop":
+			opts.Fit = fitParam
+		default:
+			err = errors.New("fit must be one of: cover, contain, smartcrop")
+			return
+		}
+	}
+
+	if formatParam := context.QueryParam("fmt"); formatParam != "" {
+		switch formatParam {
+		case "jpeg", "png", "webp":
+			opts.Format = formatParam
+		default:
+			err = errors.New("fmt must be one of: jpeg, png, webp")
+			return
+		}
+	}
+
+	if qualityParam := context.QueryParam("q"); qualityParam != "" {
+		qualityValue, parseError := strconv.Atoi(qualityParam)
+		if parseError != nil || qualityValue < 1 || qualityValue > 100 {
+			err = errors.New("q must be an integer between 1 and 100")
+			return
+		}
+		opts.Quality = qualityValue
+	}
+
+	if context.QueryParam("grayscale") == "1" {
+		opts.Grayscale = true
+	}
+
+	return
+}
+
+// parseCustomDimensions reads the w/h query parameters for the /custom
+// endpoint, bounded to avoid someone requesting an enormous resize as a
+// cheap denial of service.
+func parseCustomDimensions(context echo.Context) (width, height int, err error) {
+	width, widthError := strconv.Atoi(context.QueryParam("w"))
+	if widthError != nil {
+		err = errors.New("w must be an integer")
+		return
+	}
+
+	height, heightError := strconv.Atoi(context.QueryParam("h"))
+	if heightError != nil {
+		err = errors.New("h must be an integer")
+		return
+	}
+
+	if width < minCustomDimension || width > maxCustomDimension || height < minCustomDimension || height > maxCustomDimension {
+		err = fmt.Errorf("w and h must each be between %d and %d", minCustomDimension, maxCustomDimension)
+		return
+	}
+
+	return
+}
+
+func transformCacheKey(url string, opts transformOptions) string {
+	hash := sha256.Sum256([]byte(url + "|" + opts.String()))
+	return hex.EncodeToString(hash[:])
+}
+
+// contentHash hashes the served bytes themselves, so it can be used as an
+// ETag that changes whenever the response body does, even if the cache key
+// that produced it does not.
+func contentHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func fitImage(originalImage image.Image, opts transformOptions) (result image.Image, err error) {
+	boundsSize := originalImage.Bounds().Size()
+	originalSize := imageSize{Width: boundsSize.X, Height: boundsSize.Y}
+
+	switch opts.Fit {
+	case "smartcrop":
+		analyzer := smartcrop.NewAnalyzer(nfnt.NewDefaultResizer())
+		cropRectangle, cropError := analyzer.FindBestCrop(originalImage, opts.Width, opts.Height)
+		if cropError != nil {
+			err = cropError
+			return
+		}
+
+		croppedImage := transform.Crop(originalImage, cropRectangle)
+		result = transform.Resize(croppedImage, opts.Width, opts.Height, transform.MitchellNetravali)
+		return
+	case "contain":
+		targetAspectRatio := float64(opts.Width) / float64(opts.Height)
+		originalAspectRatio := float64(originalSize.Width) / float64(originalSize.Height)
+
+		width, height := opts.Width, opts.Height
+		if originalAspectRatio > targetAspectRatio {
+			height = int(float64(opts.Width)/originalAspectRatio + 0.5)
+		} else {
+			width = int(float64(opts.Height)*originalAspectRatio + 0.5)
+		}
+
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+
+		result = transform.Resize(originalImage, width, height, transform.MitchellNetravali)
+		return
+	default:
+		croppedImage := transform.Crop(originalImage, getCroppingRectangleForAspectRatio(originalSize, float64(opts.Width)/float64(opts.Height)))
+		result = transform.Resize(croppedImage, opts.Width, opts.Height, transform.MitchellNetravali)
+		return
+	}
+}
+
+func encodeImage(img image.Image, opts transformOptions) (encoded []byte, err error) {
+	var buffer bytes.Buffer
+
+	switch opts.Format {
+	case "png":
+		err = imgio.PNGEncoder()(&buffer, img)
+	case "webp":
+		err = webp.Encode(&buffer, img, &webp.Options{Quality: float32(opts.Quality)})
+	default:
+		err = imgio.JPEGEncoder(opts.Quality)(&buffer, img)
+	}
+	if err != nil {
+		return
+	}
+
+	encoded = buffer.Bytes()
+
+	return
+}
+
+// transformImage blurs the full-resolution original (if requested) before
+// fitting it into opts' target box, matching the pre-ImageSource behavior of
+// blurring the original and then cropping/resizing it down: applying the
+// same radius after the resize instead would blur a already-small image far
+// more aggressively than the radius suggests. Grayscale is applied after the
+// fit since it is resolution-independent. The result is encoded in opts'
+// format. This is the per-request counterpart to the cached original.
+func transformImage(originalImage image.Image, opts transformOptions) (result []byte, err error) {
+	blurred := originalImage
+	if opts.Blur > 0 {
+		blurred = blur.Gaussian(originalImage, opts.Blur)
+	}
+
+	fitted, fitError := fitImage(blurred, opts)
+	if fitError != nil {
+		err = fitError
+		return
+	}
+
+	if opts.Grayscale {
+		fitted = effect.Grayscale(fitted)
+	}
+
+	result, err = encodeImage(fitted, opts)
+
+	return
+}
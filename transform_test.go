@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	pngcodec "image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/anthonynsimon/bild/blur"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	return img
+}
+
+func newTestContext(rawQuery string) echo.Context {
+	request := httptest.NewRequest(http.MethodGet, "/small.jpg?"+rawQuery, nil)
+	recorder := httptest.NewRecorder()
+	return echo.New().NewContext(request, recorder)
+}
+
+func TestParseTransformOptionsDefaults(test *testing.T) {
+	opts, err := parseTransformOptions(newTestContext(""), 320, 320)
+
+	assert.NoError(test, err)
+	assert.Equal(test, transformOptions{Width: 320, Height: 320, Blur: defaultBlurRadius, Fit: "cover", Format: "jpeg", Quality: imageQuality}, opts)
+}
+
+func TestParseTransformOptionsOverrides(test *testing.T) {
+	query := url.Values{"blur": {"0"}, "fit": {"smartcrop"}, "fmt": {"webp"}, "q": {"50"}, "grayscale": {"1"}}
+	opts, err := parseTransformOptions(newTestContext(query.Encode()), 320, 320)
+
+	assert.NoError(test, err)
+	assert.Equal(test, transformOptions{Width: 320, Height: 320, Blur: 0, Fit: "smartcrop", Format: "webp", Quality: 50, Grayscale: true}, opts)
+}
+
+func TestParseTransformOptionsRejectsBlurOutOfRange(test *testing.T) {
+	_, err := parseTransformOptions(newTestContext("blur=51"), 320, 320)
+
+	assert.Error(test, err)
+}
+
+func TestParseTransformOptionsRejectsUnknownFit(test *testing.T) {
+	_, err := parseTransformOptions(newTestContext("fit=zoom"), 320, 320)
+
+	assert.Error(test, err)
+}
+
+func TestParseCustomDimensions(test *testing.T) {
+	width, height, err := parseCustomDimensions(newTestContext("w=1280&h=720"))
+
+	assert.NoError(test, err)
+	assert.Equal(test, 1280, width)
+	assert.Equal(test, 720, height)
+}
+
+func TestParseCustomDimensionsRejectsOutOfBounds(test *testing.T) {
+	_, _, err := parseCustomDimensions(newTestContext("w=99999&h=720"))
+
+	assert.Error(test, err)
+}
+
+func TestEncodeImagePNGIsFlushedAndDecodable(test *testing.T) {
+	encoded, err := encodeImage(newTestImage(8, 8), transformOptions{Format: "png"})
+
+	assert.NoError(test, err)
+	assert.NotEmpty(test, encoded)
+
+	decoded, decodeError := pngcodec.Decode(bytes.NewReader(encoded))
+	assert.NoError(test, decodeError)
+	assert.Equal(test, 8, decoded.Bounds().Dx())
+}
+
+func TestFitImageSmartcrop(test *testing.T) {
+	result, err := fitImage(newTestImage(100, 60), transformOptions{Width: 40, Height: 40, Fit: "smartcrop"})
+
+	assert.NoError(test, err)
+	assert.Equal(test, 40, result.Bounds().Dx())
+	assert.Equal(test, 40, result.Bounds().Dy())
+}
+
+func TestFitImageContainClampsExtremeAspectRatios(test *testing.T) {
+	result, err := fitImage(newTestImage(4000, 16), transformOptions{Width: 20, Height: 320, Fit: "contain"})
+
+	assert.NoError(test, err)
+	assert.Equal(test, 20, result.Bounds().Dx())
+	assert.Equal(test, 1, result.Bounds().Dy())
+}
+
+func TestTransformImageBlursBeforeFitSoDefaultRadiusMatchesPriorOutput(test *testing.T) {
+	blurredThenFitted, err := transformImage(newTestImage(320, 320), transformOptions{Width: 20, Height: 20, Fit: "cover", Format: "jpeg", Quality: imageQuality, Blur: defaultBlurRadius})
+	assert.NoError(test, err)
+
+	fitted, fitError := fitImage(newTestImage(320, 320), transformOptions{Width: 20, Height: 20, Fit: "cover"})
+	assert.NoError(test, fitError)
+	fittedThenBlurred, encodeError := encodeImage(blur.Gaussian(fitted, defaultBlurRadius), transformOptions{Format: "jpeg", Quality: imageQuality})
+	assert.NoError(test, encodeError)
+
+	assert.NotEqual(test, fittedThenBlurred, blurredThenFitted)
+
+	priorFitted, priorFitError := fitImage(blur.Gaussian(newTestImage(320, 320), defaultBlurRadius), transformOptions{Width: 20, Height: 20, Fit: "cover"})
+	assert.NoError(test, priorFitError)
+	priorOutput, priorEncodeError := encodeImage(priorFitted, transformOptions{Format: "jpeg", Quality: imageQuality})
+	assert.NoError(test, priorEncodeError)
+
+	assert.Equal(test, priorOutput, blurredThenFitted)
+}
+
+func TestContentHashDiffersByBytes(test *testing.T) {
+	assert.NotEqual(test, contentHash([]byte("a")), contentHash([]byte("b")))
+	assert.Equal(test, contentHash([]byte("a")), contentHash([]byte("a")))
+}
+
+func TestTransformCacheKeyDiffersByParams(test *testing.T) {
+	base := transformOptions{Width: 320, Height: 320, Blur: defaultBlurRadius, Fit: "cover", Format: "jpeg", Quality: imageQuality}
+	blurred := base
+	blurred.Blur = 0
+
+	assert.NotEqual(test, transformCacheKey("https://example.com/a.jpg", base), transformCacheKey("https://example.com/a.jpg", blurred))
+	assert.Equal(test, transformCacheKey("https://example.com/a.jpg", base), transformCacheKey("https://example.com/a.jpg", base))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const defaultRefreshRPS = 5.0
+
+// workerCount returns the size of the precache worker pool: WORKER_COUNT if
+// set to a positive integer, otherwise the number of available CPUs.
+func workerCount() int {
+	if raw := os.Getenv("WORKER_COUNT"); raw != "" {
+		if count, err := strconv.Atoi(raw); err == nil && count > 0 {
+			return count
+		}
+	}
+
+	return runtime.NumCPU()
+}
+
+// refreshRateLimiter returns a limiter honoring REFRESH_RPS, so precaching
+// doesn't hammer a source's API past what it allows.
+func refreshRateLimiter() *rate.Limiter {
+	rps := defaultRefreshRPS
+
+	if raw := os.Getenv("REFRESH_RPS"); raw != "" {
+		if parsed, err := strconv.ParseFloat(raw, 64); err == nil && parsed > 0 {
+			rps = parsed
+		}
+	}
+
+	return rate.NewLimiter(rate.Limit(rps), 1)
+}
+
+// precacheImage decodes url's original once and transforms it into every
+// registered size, rather than only the largest, so a fresh URL's first
+// request for any size is already warm.
+func precacheImage(url string, sizes imageSizes) {
+	original, originalError := getOriginalImage(url)
+	if originalError != nil {
+		return
+	}
+
+	decoded, decodeError := bytesToImage(original.Data)
+	if decodeError != nil {
+		return
+	}
+
+	if hash, hashError := computeBlurHash(decoded); hashError == nil {
+		imageBlurHashes.Set(url, hash)
+	}
+
+	for _, size := range sizes.Sizes {
+		opts := transformOptions{Width: size.Width, Height: size.Height, Blur: defaultBlurRadius, Fit: "cover", Format: "jpeg", Quality: imageQuality}
+		getImageFromDecoded(url, opts, decoded)
+	}
+}
+
+// precacheWorker pulls URLs off jobs until either jobs is closed or ctx is
+// cancelled, which happens as soon as a new refresh cycle starts so stale
+// in-flight jobs from the previous one stop doing work.
+func precacheWorker(ctx context.Context, jobs <-chan string, sizes imageSizes, limiter *rate.Limiter) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case url, ok := <-jobs:
+			if !ok {
+				return
+			}
+
+			if err := limiter.Wait(ctx); err != nil {
+				return
+			}
+
+			precacheImage(url, sizes)
+		}
+	}
+}
+
+// precacheImages warms the cache for imageURLs using a pool of workerCount
+// workers governed by refreshRateLimiter, replacing the single serial
+// worker that used to take 5 seconds per image regardless of hardware.
+func precacheImages(ctx context.Context, imageURLs []string) {
+	sizes := getImageSizes()
+	limiter := refreshRateLimiter()
+	jobs := make(chan string, len(imageURLs))
+
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			precacheWorker(ctx, jobs, sizes, limiter)
+		}()
+	}
+
+feedJobs:
+	for _, url := range imageURLs {
+		select {
+		case jobs <- url:
+		case <-ctx.Done():
+			break feedJobs
+		}
+	}
+	close(jobs)
+
+	workers.Wait()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerCountDefaultsToNumCPU(test *testing.T) {
+	os.Unsetenv("WORKER_COUNT")
+
+	assert.Equal(test, runtime.NumCPU(), workerCount())
+}
+
+func TestWorkerCountHonorsEnvVar(test *testing.T) {
+	os.Setenv("WORKER_COUNT", "3")
+	defer os.Unsetenv("WORKER_COUNT")
+
+	assert.Equal(test, 3, workerCount())
+}
+
+func TestWorkerCountIgnoresInvalidEnvVar(test *testing.T) {
+	os.Setenv("WORKER_COUNT", "not-a-number")
+	defer os.Unsetenv("WORKER_COUNT")
+
+	assert.Equal(test, runtime.NumCPU(), workerCount())
+}
+
+func TestRefreshRateLimiterHonorsEnvVar(test *testing.T) {
+	os.Setenv("REFRESH_RPS", "2")
+	defer os.Unsetenv("REFRESH_RPS")
+
+	limiter := refreshRateLimiter()
+
+	assert.Equal(test, 2.0, float64(limiter.Limit()))
+}